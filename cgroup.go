@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// cgroupCores returns the number of cores allowed by the CPU quota of the
+// process' own cgroup, as found in /proc/self/cgroup, or 0 if there is no
+// quota or it could not be determined. Both cgroup v1 (cpu.cfs_quota_us and
+// cpu.cfs_period_us) and v2 (cpu.max) are checked, and the quotas of parent
+// cgroups are taken into account as they limit their children too.
+func cgroupCores() int {
+	return cgroupCoresAt("/proc", "/sys/fs/cgroup")
+}
+
+// cgroupCoresAt is cgroupCores with the roots of /proc and /sys/fs/cgroup
+// given. A v1 hierarchy may be mounted under the name of its controller list,
+// such as cpu,cpuacct, with or without a cpu symlink, so both are tried; v2
+// is tried if v1 finds no quota, as hybrid hosts may have both.
+func cgroupCoresAt(procRoot string, cgroupRoot string) int {
+	b, err := ioutil.ReadFile(path.Join(procRoot, "self/cgroup"))
+	if err != nil {
+		return 0
+	}
+	var v1Mount, v1Path, v2Path string
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			v2Path = parts[2]
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "cpu" {
+				v1Mount = parts[1]
+				v1Path = parts[2]
+			}
+		}
+	}
+	if v1Path != "" {
+		for _, mount := range []string{v1Mount, "cpu"} {
+			if c := lowestCores(v1Path, func(dir string) int {
+				quota, err := ioutil.ReadFile(path.Join(cgroupRoot, mount, dir, "cpu.cfs_quota_us"))
+				if err != nil {
+					return 0
+				}
+				period, err := ioutil.ReadFile(path.Join(cgroupRoot, mount, dir, "cpu.cfs_period_us"))
+				if err != nil {
+					return 0
+				}
+				return quotaCores(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+			}); c > 0 {
+				return c
+			}
+		}
+	}
+	if v2Path != "" {
+		return lowestCores(v2Path, func(dir string) int {
+			b, err := ioutil.ReadFile(path.Join(cgroupRoot, dir, "cpu.max"))
+			if err != nil {
+				return 0
+			}
+			fields := strings.Fields(string(b))
+			if len(fields) != 2 || fields[0] == "max" {
+				return 0
+			}
+			return quotaCores(fields[0], fields[1])
+		})
+	}
+	return 0
+}
+
+// lowestCores walks from the cgroup path given up to the root, returning the
+// lowest non-zero number of cores reported by coresAt, or 0 if none were.
+func lowestCores(cgroup string, coresAt func(dir string) int) int {
+	var cores int
+	for dir := path.Clean("/" + cgroup); ; dir = path.Dir(dir) {
+		if c := coresAt(dir); c > 0 && (cores == 0 || c < cores) {
+			cores = c
+		}
+		if dir == "/" {
+			break
+		}
+	}
+	return cores
+}
+
+func quotaCores(quota string, period string) int {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(q) / float64(p)))
+}
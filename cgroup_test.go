@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuotaCores(t *testing.T) {
+	for _, c := range []struct {
+		quota  string
+		period string
+		cores  int
+	}{
+		{"200000", "100000", 2},
+		{"150000", "100000", 2},
+		{"50000", "100000", 1},
+		{"-1", "100000", 0},
+		{"0", "100000", 0},
+		{"100000", "0", 0},
+		{"max", "100000", 0},
+		{"", "", 0},
+	} {
+		if cores := quotaCores(c.quota, c.period); cores != c.cores {
+			t.Errorf("quotaCores(%q, %q) = %d, want %d", c.quota, c.period, cores, c.cores)
+		}
+	}
+}
+
+func TestLowestCores(t *testing.T) {
+	for _, c := range []struct {
+		cgroup string
+		quotas map[string]int
+		cores  int
+	}{
+		{"/a/b", map[string]int{}, 0},
+		{"/a/b", map[string]int{"/a/b": 4}, 4},
+		{"/a/b", map[string]int{"/a/b": 4, "/a": 2}, 2},
+		{"/a/b", map[string]int{"/a/b": 2, "/": 8}, 2},
+		{"a/b/", map[string]int{"/a": 3}, 3},
+		{"/", map[string]int{"/": 1}, 1},
+	} {
+		if cores := lowestCores(c.cgroup, func(dir string) int { return c.quotas[dir] }); cores != c.cores {
+			t.Errorf("lowestCores(%q, %v) = %d, want %d", c.cgroup, c.quotas, cores, c.cores)
+		}
+	}
+}
+
+func TestCgroupCoresAt(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		cgroup string
+		files  map[string]string
+		cores  int
+	}{
+		{"none", "", nil, 0},
+		{"v1", "4:cpu,cpuacct:/a\n", map[string]string{
+			"cpu/a/cpu.cfs_quota_us":  "300000\n",
+			"cpu/a/cpu.cfs_period_us": "100000\n",
+		}, 3},
+		{"v1 without cpu symlink", "4:cpu,cpuacct:/a\n", map[string]string{
+			"cpu,cpuacct/a/cpu.cfs_quota_us":  "200000\n",
+			"cpu,cpuacct/a/cpu.cfs_period_us": "100000\n",
+		}, 2},
+		{"v2", "0::/a\n", map[string]string{
+			"a/cpu.max": "100000 100000\n",
+		}, 1},
+		{"v2 max", "0::/a\n", map[string]string{
+			"a/cpu.max": "max 100000\n",
+		}, 0},
+		{"v1 without quota falls back to v2", "4:cpu,cpuacct:/a\n0::/b\n", map[string]string{
+			"cpu/a/cpu.cfs_quota_us":  "-1\n",
+			"cpu/a/cpu.cfs_period_us": "100000\n",
+			"b/cpu.max":               "200000 100000\n",
+		}, 2},
+	} {
+		root, err := ioutil.TempDir("", "cgroup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string]string{"proc/self/cgroup": c.cgroup}
+		for name, content := range c.files {
+			files[filepath.Join("sys", name)] = content
+		}
+		for name, content := range files {
+			name = filepath.Join(root, name)
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if cores := cgroupCoresAt(filepath.Join(root, "proc"), filepath.Join(root, "sys")); cores != c.cores {
+			t.Errorf("%s: cgroupCoresAt = %d, want %d", c.name, cores, c.cores)
+		}
+		os.RemoveAll(root)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gholt/brimtime"
+	"github.com/gholt/store"
+)
+
+// storeHandler serves the store over HTTP for debugging. Keys are given as 32
+// hex digits, the first 16 being keyA and the last 16 keyB; GroupStore paths
+// are /parentkey/childkey while ValueStore paths are just /key. GET (with
+// Range support), HEAD, PUT, and DELETE are supported, as is GET /stats.
+type storeHandler struct{}
+
+func (h *storeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/stats" {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		stats, err := opts.store.Stats(r.Context(), opts.ExtendedStats)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, stats)
+		return
+	}
+	keys := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if (opts.GroupStore && len(keys) != 2) || (!opts.GroupStore && len(keys) != 1) {
+		http.NotFound(w, r)
+		return
+	}
+	var keyA, keyB, childKeyA, childKeyB uint64
+	var err error
+	if keyA, keyB, err = parseHexKey(keys[0]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.GroupStore {
+		if childKeyA, childKeyB, err = parseHexKey(keys[1]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case "GET", "HEAD":
+		var timestamp int64
+		var value []byte
+		if opts.GroupStore {
+			timestamp, value, err = opts.store.(store.GroupStore).Read(ctx, keyA, keyB, childKeyA, childKeyB, nil)
+		} else {
+			timestamp, value, err = opts.store.(store.ValueStore).Read(ctx, keyA, keyB, nil)
+		}
+		if store.IsNotFound(err) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Timestamp", strconv.FormatInt(timestamp, 10))
+		http.ServeContent(w, r, "", time.Unix(0, timestamp*int64(time.Microsecond)), bytes.NewReader(value))
+	case "PUT":
+		value, err := ioutil.ReadAll(io.LimitReader(r.Body, maxValueLength+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		valueCap, err := opts.store.ValueCap(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(value) > maxValueLength || uint64(len(value)) > uint64(valueCap) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		timestamp := brimtime.TimeToUnixMicro(time.Now())
+		var oldTimestamp int64
+		if opts.GroupStore {
+			oldTimestamp, err = opts.store.(store.GroupStore).Write(ctx, keyA, keyB, childKeyA, childKeyB, timestamp, value)
+		} else {
+			oldTimestamp, err = opts.store.(store.ValueStore).Write(ctx, keyA, keyB, timestamp, value)
+		}
+		writeResult(w, timestamp, oldTimestamp, err)
+	case "DELETE":
+		timestamp := brimtime.TimeToUnixMicro(time.Now())
+		var oldTimestamp int64
+		if opts.GroupStore {
+			oldTimestamp, err = opts.store.(store.GroupStore).Delete(ctx, keyA, keyB, childKeyA, childKeyB, timestamp)
+		} else {
+			oldTimestamp, err = opts.store.(store.ValueStore).Delete(ctx, keyA, keyB, timestamp)
+		}
+		writeResult(w, timestamp, oldTimestamp, err)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// writeResult responds to a PUT or DELETE; a conflict is reported if the store
+// already held a newer timestamp than the one given.
+func writeResult(w http.ResponseWriter, timestamp int64, oldTimestamp int64, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Timestamp", strconv.FormatInt(timestamp, 10))
+	if oldTimestamp > timestamp {
+		http.Error(w, fmt.Sprintf("superseded by timestamp %d", oldTimestamp), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseHexKey(s string) (uint64, uint64, error) {
+	if len(s) != 32 {
+		return 0, 0, fmt.Errorf("key %q is not 32 hex digits", s)
+	}
+	keyA, err := strconv.ParseUint(s[:16], 16, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("key %q is not 32 hex digits", s)
+	}
+	keyB, err := strconv.ParseUint(s[16:], 16, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("key %q is not 32 hex digits", s)
+	}
+	return keyA, keyB, nil
+}
@@ -3,12 +3,18 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,29 +29,44 @@ import (
 )
 
 type optsStruct struct {
-	Scale         float64 `long:"scale" description:"Sets the overall scale factor for many settings; default is 1, set lower (e.g. 0.5) to decrease memory usage."`
-	API           string  `long:"api" description:"Connect to the address given, using Oort API instead of local store"`
-	GroupStore    bool    `short:"g" long:"groupstore" description:"Use GroupStore instead of ValueStore."`
-	Clients       int     `long:"clients" description:"The number of clients. Default: cores*cores"`
-	Cores         int     `long:"cores" description:"The number of cores. Default: CPU core count"`
-	Debug         bool    `long:"debug" description:"Turns on debug output."`
-	ExtendedStats bool    `long:"extended-stats" description:"Extended statistics at exit."`
-	Metrics       bool    `long:"metrics" description:"Displays metrics one per minute."`
-	Length        int     `short:"l" long:"length" description:"Length of values. Default: 0"`
-	Number        int     `short:"n" long:"number" description:"Number of keys. Default: 0"`
-	Random        int     `long:"random" description:"Random number seed. Default: 0"`
-	Replicate     bool    `long:"replicate" description:"Creates a second value store that will test replication."`
-	Timestamp     int64   `long:"timestamp" description:"Timestamp value. Default: current time"`
-	TombstoneAge  int     `long:"tombstone-age" description:"Seconds to keep tombstones. Default: 4 hours"`
-	MaxGroupSize  int     `long:"max-group-size" description:"Maximum number of items per group for writegroup."`
+	Scale         float64  `long:"scale" description:"Sets the overall scale factor for many settings; default is 1, set lower (e.g. 0.5) to decrease memory usage."`
+	API           string   `long:"api" description:"Connect to the address given, using Oort API instead of local store"`
+	GroupStore    bool     `short:"g" long:"groupstore" description:"Use GroupStore instead of ValueStore."`
+	Clients       int      `long:"clients" description:"The number of clients. Default: cores*cores"`
+	Cores         int      `long:"cores" description:"The number of cores. Default: CPU core count, limited by any cgroup CPU quota"`
+	Debug         bool     `long:"debug" description:"Turns on debug output."`
+	ExtendedStats bool     `long:"extended-stats" description:"Extended statistics at exit."`
+	Metrics       bool     `long:"metrics" description:"Displays metrics one per minute."`
+	AllocStats    bool     `long:"alloc-stats" description:"Displays allocations per store operation, or per item for group tests, after each test that walks the keyspace."`
+	Length        int      `short:"l" long:"length" description:"Length of values. Default: 0"`
+	Number        int      `short:"n" long:"number" description:"Number of keys. Default: 0"`
+	Random        int      `long:"random" description:"Random number seed. Default: 0"`
+	Replicate     bool     `long:"replicate" description:"Creates a second value store that will test replication."`
+	Timestamp     int64    `long:"timestamp" description:"Timestamp value. Default: current time"`
+	TombstoneAge  int      `long:"tombstone-age" description:"Seconds to keep tombstones. Default: 4 hours"`
+	MaxGroupSize  int      `long:"max-group-size" description:"Maximum number of items per group for writegroup."`
+	StallTime     int      `long:"stall-time" description:"Milliseconds a single write may take before it is counted as a stall. Default: 100"`
+	SoakTime      int      `long:"soak-time" description:"Minutes the soak test runs for. Default: 60"`
+	SoakRestart   bool     `long:"soak-restart" description:"Cleanly shuts down and restarts the store(s) after each soak cycle; unclean crashes are not simulated."`
+	SoakMemory    float64  `long:"soak-memory" description:"Fail the soak test if the process uses more than this many gigabytes of memory. Default: no limit"`
+	OpenMetrics   string   `long:"openmetrics" description:"Writes test results in OpenMetrics text format to the file given."`
+	Compare       []string `long:"compare" description:"Compares the results in the OpenMetrics files given, from earlier runs with --openmetrics, side by side and exits. May be given more than once."`
+	HTTP          string   `long:"http" description:"Serves the store over HTTP at the address given, for debugging: GET/PUT/DELETE /<32 hex key>[/<32 hex child key>] and GET /stats"`
+	CorruptBytes  int      `long:"corrupt-bytes" description:"Number of random bytes the corrupt test flips in each store file. Default: 1"`
+	Timeout       int      `long:"timeout" description:"Milliseconds a single store operation may take before it is cancelled and counted as an error. Default: no limit"`
+	RecoveryCheck bool     `long:"recovery-check" description:"After shutdown, starts the store(s) again and verifies their content matches what they held before shutdown."`
 	Positional    struct {
-		Tests []string `name:"tests" description:"blockprof cpuprof memprof write lookup read delete writegroup lookupgroup readgroup run"`
+		Tests []string `name:"tests" description:"blockprof cpuprof memprof audit corrupt write lookup lookupreplicated read delete writegroup lookupgroup readgroup fingerprint flush restart soak run"`
 	} `positional-args:"yes"`
 	blockprofi int
 	blockproff *os.File
 	cpuprofi   int
 	cpuproff   *os.File
 	memprofi   int
+	results    []result
+	path       string
+	pathTOC    string
+	storeDown  bool
 	keyspace   []byte
 	buffers    [][]byte
 	st         runtime.MemStats
@@ -55,6 +76,10 @@ type optsStruct struct {
 	rring      *ringPipe
 }
 
+// maxValueLength is the size of the read buffers, and so the longest value the
+// tests and the HTTP handler will work with.
+const maxValueLength = 4 * 1024 * 1024
+
 var opts optsStruct
 var parser = flags.NewParser(&opts, flags.Default)
 
@@ -77,31 +102,54 @@ func main() {
 		InfoWriter:     os.Stdout,
 		DebugWriter:    debugWriter,
 	})
+	if len(opts.Compare) > 0 {
+		if err := compareOpenMetrics(opts.Compare); err != nil {
+			flog.CriticalPrintf("%s", err)
+			os.Exit(1)
+		}
+		return
+	}
 	flog.InfoPrintf("init:")
 	for _, arg := range opts.Positional.Tests {
 		switch arg {
 		case "blockprof":
 		case "cpuprof":
 		case "memprof":
+		case "audit":
+		case "corrupt":
 		case "delete":
+		case "fingerprint":
+		case "flush":
 		case "lookupgroup":
 		case "readgroup":
 		case "writegroup":
 		case "lookup":
+		case "lookupreplicated":
 		case "read":
+		case "restart":
 		case "run":
+		case "soak":
 		case "write":
 		default:
 			flog.CriticalPrintf("unknown test named %#v", arg)
 			os.Exit(1)
 		}
 	}
+	if err := validateOpts(); err != nil {
+		flog.CriticalPrintf("%s", err)
+		os.Exit(1)
+	}
 	if opts.Cores > 0 {
 		runtime.GOMAXPROCS(opts.Cores)
 	} else if os.Getenv("GOMAXPROCS") == "" {
-		runtime.GOMAXPROCS(runtime.NumCPU())
+		cores := runtime.NumCPU()
+		if c := cgroupCores(); c > 0 && c < cores {
+			cores = c
+		}
+		runtime.GOMAXPROCS(cores)
 	}
 	opts.Cores = runtime.GOMAXPROCS(0)
+	flog.InfoPrintf("%d effective cores", opts.Cores)
 	if opts.Clients == 0 {
 		opts.Clients = opts.Cores * opts.Cores
 	}
@@ -112,7 +160,7 @@ func main() {
 	brimio.NewSeededScrambled(int64(opts.Random)).Read(opts.keyspace)
 	opts.buffers = make([][]byte, opts.Clients)
 	for i := 0; i < opts.Clients; i++ {
-		opts.buffers[i] = make([]byte, 4*1024*1024)
+		opts.buffers[i] = make([]byte, maxValueLength)
 	}
 	memstat()
 	flog.InfoPrintf("start:")
@@ -147,6 +195,15 @@ func main() {
 	if opts.MaxGroupSize < 1 {
 		opts.MaxGroupSize = 100
 	}
+	if opts.StallTime < 1 {
+		opts.StallTime = 100
+	}
+	if opts.SoakTime < 1 {
+		opts.SoakTime = 60
+	}
+	if opts.CorruptBytes < 1 {
+		opts.CorruptBytes = 1
+	}
 	wg := &sync.WaitGroup{}
 	if opts.Replicate {
 		conn, rconn := net.Pipe()
@@ -216,6 +273,19 @@ func main() {
 			vscfg.LogDebug = logger.DebugPrintf
 		}
 	}
+	// The store defaults its paths the same way; corrupt needs to know where
+	// the files are.
+	if opts.GroupStore {
+		opts.path, opts.pathTOC = gscfg.Path, gscfg.PathTOC
+	} else {
+		opts.path, opts.pathTOC = vscfg.Path, vscfg.PathTOC
+	}
+	if opts.path == "" {
+		opts.path = "."
+	}
+	if opts.pathTOC == "" {
+		opts.pathTOC = opts.path
+	}
 	var restartChan chan error
 	if opts.GroupStore {
 		if opts.API != "" {
@@ -279,8 +349,25 @@ func main() {
 	wg.Wait()
 	dur := time.Now().Sub(begin)
 	flog.InfoPrintf("%s to start", dur)
+	if opts.HTTP != "" {
+		go func() {
+			if err := http.ListenAndServe(opts.HTTP, &storeHandler{}); err != nil {
+				flog.ErrorPrintf("http: %s", err)
+			}
+		}()
+	}
 	memstat()
 	for _, arg := range opts.Positional.Tests {
+		if opts.storeDown {
+			flog.ErrorPrintf("%s: skipped, a store is down", arg)
+			continue
+		}
+		lastMallocs := opts.st.Mallocs
+		lastAlloc := opts.st.TotalAlloc
+		// ops is the number of store operations the test performed, for
+		// --alloc-stats, counting items rather than groups for the group
+		// tests; it stays 0 for tests that don't walk the keyspace.
+		var ops uint64
 		switch arg {
 		case "blockprof":
 			if opts.blockproff != nil {
@@ -327,24 +414,46 @@ func main() {
 			opts.memprofi++
 			pprof.WriteHeapProfile(f)
 			f.Close()
+		case "audit":
+			audit()
+		case "corrupt":
+			corrupt()
 		case "delete":
 			delete()
+			ops = uint64(opts.Number)
+		case "fingerprint":
+			ops = fingerprint()
+		case "flush":
+			flush()
 		case "lookupgroup":
-			lookupgroup()
+			ops = lookupgroup()
 		case "readgroup":
-			readgroup()
+			ops = readgroup()
 		case "writegroup":
-			writegroup()
+			ops = writegroup()
 		case "lookup":
 			lookup()
+			ops = uint64(opts.Number)
+		case "lookupreplicated":
+			lookupreplicated()
+			ops = uint64(opts.Number)
 		case "read":
 			read()
+			ops = uint64(opts.Number)
+		case "restart":
+			restart()
 		case "run":
 			run()
+		case "soak":
+			soak()
 		case "write":
 			write()
+			ops = uint64(opts.Number)
 		}
 		memstat()
+		if opts.AllocStats && ops > 0 {
+			flog.InfoPrintf("%s: %.2f allocs/op, %.0f bytes/op", arg, float64(opts.st.Mallocs-lastMallocs)/float64(ops), float64(opts.st.TotalAlloc-lastAlloc)/float64(ops))
+		}
 	}
 	if opts.blockproff != nil {
 		runtime.SetBlockProfileRate(0)
@@ -357,6 +466,19 @@ func main() {
 		opts.cpuproff.Close()
 		opts.cpuproff = nil
 	}
+	if opts.storeDown {
+		flog.ErrorPrintf("a store is down; skipping flush and stats")
+		if opts.repstore != nil {
+			ctx, cancel := opContext()
+			opts.repstore.Shutdown(ctx)
+			cancel()
+		}
+		ctx, cancel := opContext()
+		opts.store.Shutdown(ctx)
+		cancel()
+		writeResults()
+		return
+	}
 	flog.InfoPrintf("flush:")
 	begin = time.Now()
 	if opts.repstore != nil {
@@ -481,6 +603,16 @@ func main() {
 	if opts.repstore != nil {
 		flog.InfoPrintf("drops %d %d", opts.ring.sendDrops, opts.rring.sendDrops)
 	}
+	var recoverySum uint64
+	var recoveryValues uint64
+	var rrecoverySum uint64
+	var rrecoveryValues uint64
+	if opts.RecoveryCheck {
+		recoverySum, recoveryValues = fingerprintStore(opts.store)
+		if opts.repstore != nil {
+			rrecoverySum, rrecoveryValues = fingerprintStore(opts.repstore)
+		}
+	}
 	flog.InfoPrintf("shutdown:")
 	begin = time.Now()
 	if opts.repstore != nil {
@@ -494,6 +626,86 @@ func main() {
 	wg.Wait()
 	dur = time.Now().Sub(begin)
 	flog.InfoPrintf("%s to shutdown", dur)
+	if opts.RecoveryCheck {
+		recoveryCheck("", opts.store, recoverySum, recoveryValues)
+		if opts.repstore != nil {
+			recoveryCheck("replicated ", opts.repstore, rrecoverySum, rrecoveryValues)
+		}
+	}
+	writeResults()
+}
+
+// writeResults writes the recorded results to --openmetrics, if given.
+func writeResults() {
+	if opts.OpenMetrics != "" {
+		if err := writeOpenMetrics(opts.OpenMetrics); err != nil {
+			flog.CriticalPrintf("%s", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// validateOpts returns a descriptive error for options that are out of range
+// or do not make sense together, rather than letting them be silently
+// replaced with defaults later.
+func validateOpts() error {
+	if opts.Scale < 0 {
+		return fmt.Errorf("--scale must not be negative; got %f", opts.Scale)
+	}
+	for _, o := range []struct {
+		name  string
+		value int
+	}{
+		{"--clients", opts.Clients},
+		{"--cores", opts.Cores},
+		{"--length", opts.Length},
+		{"--number", opts.Number},
+		{"--tombstone-age", opts.TombstoneAge},
+		{"--max-group-size", opts.MaxGroupSize},
+		{"--stall-time", opts.StallTime},
+		{"--soak-time", opts.SoakTime},
+		{"--timeout", opts.Timeout},
+		{"--corrupt-bytes", opts.CorruptBytes},
+	} {
+		if o.value < 0 {
+			return fmt.Errorf("%s must not be negative; got %d", o.name, o.value)
+		}
+	}
+	if opts.SoakMemory < 0 {
+		return fmt.Errorf("--soak-memory must not be negative; got %f", opts.SoakMemory)
+	}
+	if opts.Length > maxValueLength {
+		return fmt.Errorf("--length must be no more than %d, the size of the read buffers; got %d", maxValueLength, opts.Length)
+	}
+	if opts.API != "" && opts.Replicate {
+		return fmt.Errorf("--replicate cannot be used with --api")
+	}
+	if opts.API != "" && opts.RecoveryCheck {
+		return fmt.Errorf("--recovery-check cannot be used with --api")
+	}
+	if !opts.Replicate {
+		for _, arg := range opts.Positional.Tests {
+			if arg == "lookupreplicated" {
+				return fmt.Errorf("test %#v requires --replicate", arg)
+			}
+		}
+	}
+	if opts.API != "" {
+		for _, arg := range opts.Positional.Tests {
+			if arg == "corrupt" {
+				return fmt.Errorf("test %#v cannot be used with --api", arg)
+			}
+		}
+	}
+	if !opts.GroupStore {
+		for _, arg := range opts.Positional.Tests {
+			switch arg {
+			case "lookupgroup", "readgroup", "writegroup":
+				return fmt.Errorf("test %#v requires --groupstore", arg)
+			}
+		}
+	}
+	return nil
 }
 
 func memstat() {
@@ -504,9 +716,95 @@ func memstat() {
 	flog.InfoPrintf("%0.2fG total alloc, %0.2fG delta", float64(opts.st.TotalAlloc)/1024/1024/1024, float64(deltaAlloc)/1024/1024/1024)
 }
 
+// stallCounter tracks the stalls of a single client without locking, to be
+// added to the shared stalls once the client is done.
+type stallCounter struct {
+	limit   time.Duration
+	count   uint64
+	total   time.Duration
+	longest time.Duration
+}
+
+// observe records how long a write took, counting it if it was a stall.
+func (c *stallCounter) observe(d time.Duration) {
+	if d <= c.limit {
+		return
+	}
+	c.count++
+	c.total += d
+	if d > c.longest {
+		c.longest = d
+	}
+}
+
+// stalls tracks writes that took longer than opts.StallTime to be accepted,
+// usually an indication the store's disk writing cannot keep up.
+type stalls struct {
+	lock    sync.Mutex
+	count   uint64
+	total   time.Duration
+	longest time.Duration
+}
+
+func (s *stalls) add(c *stallCounter) {
+	if c.count == 0 {
+		return
+	}
+	s.lock.Lock()
+	s.count += c.count
+	s.total += c.total
+	if c.longest > s.longest {
+		s.longest = c.longest
+	}
+	s.lock.Unlock()
+}
+
+func (s *stalls) report() {
+	if s.count > 0 {
+		flog.ErrorPrintf("%d STALLED! (%s total, %s average, %s longest)", s.count, s.total, s.total/time.Duration(s.count), s.longest)
+	}
+}
+
+// opContext returns the context to use for a single store operation, which
+// will be cancelled after opts.Timeout if that is set.
+func opContext() (context.Context, context.CancelFunc) {
+	if opts.Timeout > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(opts.Timeout)*time.Millisecond)
+	}
+	return context.Background(), noCancel
+}
+
+func noCancel() {}
+
+// errs tracks errors returned by the store during a test so the test can
+// finish and report them rather than stopping the whole run.
+type errs struct {
+	lock  sync.Mutex
+	count uint64
+	first error
+}
+
+func (e *errs) add(err error) {
+	e.lock.Lock()
+	e.count++
+	if e.first == nil {
+		e.first = err
+	}
+	e.lock.Unlock()
+}
+
+// report logs any errors seen and returns how many there were.
+func (e *errs) report() uint64 {
+	if e.count > 0 {
+		flog.ErrorPrintf("%d ERRORS! (first was: %s)", e.count, e.first)
+	}
+	return e.count
+}
+
 func delete() {
 	flog.InfoPrintf("delete:")
 	var superseded uint64
+	errored := &errs{}
 	timestamp := opts.Timestamp | 1
 	begin := time.Now()
 	wg := &sync.WaitGroup{}
@@ -523,21 +821,25 @@ func delete() {
 				keys = opts.keyspace[numberPer*client*16 : numberPer*(client+1)*16]
 			}
 			if opts.GroupStore {
-				ctx := context.Background()
 				gs := opts.store.(store.GroupStore)
 				for o := 0; o < len(keys); o += 16 {
-					if oldTimestamp, err := gs.Delete(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), timestamp); err != nil {
-						panic(err)
+					ctx, cancel := opContext()
+					oldTimestamp, err := gs.Delete(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), timestamp)
+					cancel()
+					if err != nil {
+						errored.add(err)
 					} else if oldTimestamp > timestamp {
 						s++
 					}
 				}
 			} else {
-				ctx := context.Background()
 				vs := opts.store.(store.ValueStore)
 				for o := 0; o < len(keys); o += 16 {
-					if oldTimestamp, err := vs.Delete(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), timestamp); err != nil {
-						panic(err)
+					ctx, cancel := opContext()
+					oldTimestamp, err := vs.Delete(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), timestamp)
+					cancel()
+					if err != nil {
+						errored.add(err)
 					} else if oldTimestamp > timestamp {
 						s++
 					}
@@ -550,22 +852,25 @@ func delete() {
 		}(i)
 	}
 	wg.Wait()
-	opts.store.Flush(context.Background())
+	ctx, cancel := opContext()
+	if err := opts.store.Flush(ctx); err != nil {
+		errored.add(err)
+	}
+	cancel()
 	dur := time.Now().Sub(begin)
 	flog.InfoPrintf("%s %.0f/s to delete %d values (timestamp %d)", dur, float64(opts.Number)/(float64(dur)/float64(time.Second)), opts.Number, timestamp)
+	recordResult("delete", dur, uint64(opts.Number), 0)
 	if superseded > 0 {
 		flog.InfoPrintf("%d SUPERCEDED!", superseded)
 	}
+	errored.report()
 }
 
-func lookupgroup() {
+func lookupgroup() uint64 {
 	flog.InfoPrintf("lookupgroup:")
-	if !opts.GroupStore {
-		flog.CriticalPrintf("not valid for ValueStore")
-		return
-	}
 	var itemCount uint64
 	var mismatch uint64
+	errored := &errs{}
 	begin := time.Now()
 	wg := &sync.WaitGroup{}
 	wg.Add(opts.Clients)
@@ -579,13 +884,15 @@ func lookupgroup() {
 			} else {
 				keys = opts.keyspace[numberPer*client*16 : numberPer*(client+1)*16]
 			}
-			ctx := context.Background()
 			gs := opts.store.(store.GroupStore)
 			for o := 0; o < len(keys); o += 16 {
 				groupSize := 1 + (binary.BigEndian.Uint64(keys[o:]) % uint64(opts.MaxGroupSize))
+				ctx, cancel := opContext()
 				list, err := gs.LookupGroup(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]))
+				cancel()
 				if err != nil {
-					panic(err)
+					errored.add(err)
+					continue
 				}
 				atomic.AddUint64(&itemCount, uint64(len(list)))
 				if uint64(len(list)) != groupSize {
@@ -598,19 +905,19 @@ func lookupgroup() {
 	wg.Wait()
 	dur := time.Now().Sub(begin)
 	flog.InfoPrintf("%s %.0f/s to lookup %d groups (%d items)", dur, float64(opts.Number)/(float64(dur)/float64(time.Second)), opts.Number, itemCount)
+	recordResult("lookupgroup", dur, uint64(opts.Number), 0)
 	if mismatch > 0 {
 		flog.ErrorPrintf("%d MISMATCHES! (groups without the correct number of items)", mismatch)
 	}
+	errored.report()
+	return itemCount
 }
 
-func readgroup() {
+func readgroup() uint64 {
 	flog.InfoPrintf("readgroup:")
-	if !opts.GroupStore {
-		flog.ErrorPrintf("not valid for ValueStore")
-		return
-	}
 	var itemCount uint64
 	var mismatch uint64
+	errored := &errs{}
 	begin := time.Now()
 	wg := &sync.WaitGroup{}
 	wg.Add(opts.Clients)
@@ -624,14 +931,16 @@ func readgroup() {
 			} else {
 				keys = opts.keyspace[numberPer*client*16 : numberPer*(client+1)*16]
 			}
-			ctx := context.Background()
 			gs := opts.store.(store.GroupStore)
 			for o := 0; o < len(keys); o += 16 {
 				groupSize := 1 + (binary.BigEndian.Uint64(keys[o:]) % uint64(opts.MaxGroupSize))
 				if ags, ok := gs.(store.GroupStore); ok {
+					ctx, cancel := opContext()
 					itemList, err := ags.ReadGroup(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]))
+					cancel()
 					if err != nil {
-						panic(err)
+						errored.add(err)
+						continue
 					}
 					// TODO: Should probably verify all the values seem proper
 					// like read does.
@@ -652,19 +961,21 @@ func readgroup() {
 	wg.Wait()
 	dur := time.Now().Sub(begin)
 	flog.InfoPrintf("%s %.0f/s to read %d groups (%d items)", dur, float64(opts.Number)/(float64(dur)/float64(time.Second)), opts.Number, itemCount)
+	recordResult("readgroup", dur, uint64(opts.Number), 0)
 	if mismatch > 0 {
 		flog.ErrorPrintf("%d MISMATCHES! (groups without the correct number of items)", mismatch)
 	}
+	errored.report()
+	return itemCount
 }
 
-func writegroup() {
+func writegroup() uint64 {
 	flog.InfoPrintf("writegroup:")
-	if !opts.GroupStore {
-		flog.ErrorPrintf("not valid for ValueStore")
-		return
-	}
 	var itemCount uint64
 	var superseded uint64
+	errored := &errs{}
+	stalled := &stalls{}
+	stallTime := time.Duration(opts.StallTime) * time.Millisecond
 	timestamp := opts.Timestamp
 	if timestamp == 0 {
 		timestamp = 2
@@ -686,6 +997,7 @@ func writegroup() {
 			}
 			scr := brimio.NewScrambled()
 			var s uint64
+			sc := &stallCounter{limit: stallTime}
 			number := len(opts.keyspace) / 16
 			numberPer := number / opts.Clients
 			var keys []byte
@@ -694,15 +1006,19 @@ func writegroup() {
 			} else {
 				keys = opts.keyspace[numberPer*client*16 : numberPer*(client+1)*16]
 			}
-			ctx := context.Background()
 			gs := opts.store.(store.GroupStore)
 			for o := 0; o < len(keys); o += 16 {
 				groupSize := 1 + (binary.BigEndian.Uint64(keys[o:]) % uint64(opts.MaxGroupSize))
 				atomic.AddUint64(&itemCount, groupSize)
 				for p := uint64(0); p < groupSize; p++ {
 					scr.Read(randomness)
-					if oldTimestamp, err := gs.Write(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), p, p, timestamp, value); err != nil {
-						panic(err)
+					wbegin := time.Now()
+					ctx, cancel := opContext()
+					oldTimestamp, err := gs.Write(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), p, p, timestamp, value)
+					cancel()
+					sc.observe(time.Now().Sub(wbegin))
+					if err != nil {
+						errored.add(err)
 					} else if oldTimestamp > timestamp {
 						s++
 					}
@@ -711,22 +1027,47 @@ func writegroup() {
 			if s > 0 {
 				atomic.AddUint64(&superseded, s)
 			}
+			stalled.add(sc)
 			wg.Done()
 		}(i)
 	}
 	wg.Wait()
-	opts.store.Flush(context.Background())
+	ctx, cancel := opContext()
+	if err := opts.store.Flush(ctx); err != nil {
+		errored.add(err)
+	}
+	cancel()
 	dur := time.Now().Sub(begin)
 	flog.InfoPrintf("%s %.0f/s %0.2fG/s to write %d items (%d groups) (timestamp %d)", dur, float64(itemCount)/(float64(dur)/float64(time.Second)), float64(itemCount)/(float64(dur)/float64(time.Second))/1024/1024/1024, itemCount, opts.Number, timestamp)
+	recordResult("writegroup", dur, itemCount, itemCount*uint64(opts.Length))
 	if superseded > 0 {
 		flog.ErrorPrintf("%d SUPERCEDED!", superseded)
 	}
+	stalled.report()
+	errored.report()
+	return itemCount
 }
 
-func lookup() {
+func lookup() uint64 {
 	flog.InfoPrintf("lookup:")
+	return lookupStore("", opts.store)
+}
+
+// lookupreplicated runs lookup against the replicated store, such as to check
+// deletes reached it. Replication is not waited for, so it is meant to be run
+// once the stores have had time to catch up, such as after run and flush.
+func lookupreplicated() uint64 {
+	flog.InfoPrintf("lookupreplicated:")
+	return lookupStore("replicated ", opts.repstore)
+}
+
+// lookupStore looks up every key in the keyspace from the store given; name
+// is used to distinguish the output, such as for replicated stores. The
+// number of missing and deleted values is returned.
+func lookupStore(name string, st store.Store) uint64 {
 	var missing uint64
 	var deleted uint64
+	errored := &errs{}
 	begin := time.Now()
 	wg := &sync.WaitGroup{}
 	wg.Add(opts.Clients)
@@ -743,10 +1084,11 @@ func lookup() {
 			var m uint64
 			var d uint64
 			if opts.GroupStore {
-				ctx := context.Background()
-				gs := opts.store.(store.GroupStore)
+				gs := st.(store.GroupStore)
 				for o := 0; o < len(keys); o += 16 {
+					ctx, cancel := opContext()
 					timestamp, _, err := gs.Lookup(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]))
+					cancel()
 					if store.IsNotFound(err) {
 						if timestamp == 0 {
 							m++
@@ -754,14 +1096,15 @@ func lookup() {
 							d++
 						}
 					} else if err != nil {
-						panic(err)
+						errored.add(err)
 					}
 				}
 			} else {
-				ctx := context.Background()
-				vs := opts.store.(store.ValueStore)
+				vs := st.(store.ValueStore)
 				for o := 0; o < len(keys); o += 16 {
+					ctx, cancel := opContext()
 					timestamp, _, err := vs.Lookup(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]))
+					cancel()
 					if store.IsNotFound(err) {
 						if timestamp == 0 {
 							m++
@@ -769,7 +1112,7 @@ func lookup() {
 							d++
 						}
 					} else if err != nil {
-						panic(err)
+						errored.add(err)
 					}
 				}
 			}
@@ -784,20 +1127,25 @@ func lookup() {
 	}
 	wg.Wait()
 	dur := time.Now().Sub(begin)
-	flog.InfoPrintf("%s %.0f/s to lookup %d values", dur, float64(opts.Number)/(float64(dur)/float64(time.Second)), opts.Number)
+	flog.InfoPrintf("%s %.0f/s to lookup %d %svalues", dur, float64(opts.Number)/(float64(dur)/float64(time.Second)), opts.Number, name)
+	recordResult(name+"lookup", dur, uint64(opts.Number), 0)
 	if missing > 0 {
-		flog.ErrorPrintf("%d MISSING!", missing)
+		flog.ErrorPrintf("%d %sMISSING!", missing, strings.ToUpper(name))
 	}
 	if deleted > 0 {
-		flog.ErrorPrintf("%d DELETED!", deleted)
+		flog.ErrorPrintf("%d %sDELETED!", deleted, strings.ToUpper(name))
 	}
+	return missing + deleted + errored.report()
 }
 
-func read() {
+func read() uint64 {
 	flog.InfoPrintf("read:")
 	var valuesLength uint64
 	var missing uint64
 	var deleted uint64
+	var hits uint64
+	var missTime int64
+	errored := &errs{}
 	start := []byte("START67890")
 	stop := []byte("123456STOP")
 	wg := &sync.WaitGroup{}
@@ -809,46 +1157,56 @@ func read() {
 				var vl uint64
 				var m uint64
 				var d uint64
+				var h uint64
+				var mt time.Duration
 				if opts.GroupStore {
-					ctx := context.Background()
 					gs := opts.store.(store.GroupStore)
 					for o := 0; o < len(keys); o += 16 {
+						rbegin := time.Now()
+						ctx, cancel := opContext()
 						timestamp, v, err := gs.Read(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), opts.buffers[client][:0])
+						cancel()
 						if store.IsNotFound(err) {
+							mt += time.Now().Sub(rbegin)
 							if timestamp == 0 {
 								m++
 							} else {
 								d++
 							}
 						} else if err != nil {
-							panic(err)
+							errored.add(err)
 						} else if len(v) > 10 && !bytes.Equal(v[:10], start) {
-							panic("bad start to value")
+							errored.add(errors.New("bad start to value"))
 						} else if len(v) > 20 && !bytes.Equal(v[len(v)-10:], stop) {
-							panic("bad stop to value")
+							errored.add(errors.New("bad stop to value"))
 						} else {
 							vl += uint64(len(v))
+							h++
 						}
 					}
 				} else {
-					ctx := context.Background()
 					vs := opts.store.(store.ValueStore)
 					for o := 0; o < len(keys); o += 16 {
+						rbegin := time.Now()
+						ctx, cancel := opContext()
 						timestamp, v, err := vs.Read(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), opts.buffers[client][:0])
+						cancel()
 						if store.IsNotFound(err) {
+							mt += time.Now().Sub(rbegin)
 							if timestamp == 0 {
 								m++
 							} else {
 								d++
 							}
 						} else if err != nil {
-							panic(err)
+							errored.add(err)
 						} else if len(v) > 10 && !bytes.Equal(v[:10], start) {
-							panic("bad start to value")
+							errored.add(errors.New("bad start to value"))
 						} else if len(v) > 20 && !bytes.Equal(v[len(v)-10:], stop) {
-							panic("bad stop to value")
+							errored.add(errors.New("bad stop to value"))
 						} else {
 							vl += uint64(len(v))
+							h++
 						}
 					}
 				}
@@ -861,6 +1219,12 @@ func read() {
 				if d > 0 {
 					atomic.AddUint64(&deleted, d)
 				}
+				if h > 0 {
+					atomic.AddUint64(&hits, h)
+				}
+				if mt > 0 {
+					atomic.AddInt64(&missTime, int64(mt))
+				}
 			}
 			number := len(opts.keyspace) / 16
 			numberPer := number / opts.Clients
@@ -879,17 +1243,27 @@ func read() {
 	wg.Wait()
 	dur := time.Now().Sub(begin)
 	flog.InfoPrintf("%s %.0f/s %0.2fG/s to read %d values", dur, float64(opts.Number)/(float64(dur)/float64(time.Second)), float64(valuesLength)/(float64(dur)/float64(time.Second))/1024/1024/1024, opts.Number)
+	recordResult("read", dur, uint64(opts.Number), valuesLength)
 	if missing > 0 {
 		flog.ErrorPrintf("%d MISSING!", missing)
 	}
 	if deleted > 0 {
 		flog.ErrorPrintf("%d DELETED!", deleted)
 	}
+	if misses := missing + deleted; misses > 0 {
+		flog.InfoPrintf("%d hits, %d misses, %.2f%% hit ratio, %s average miss latency", hits, misses, float64(hits)*100/float64(hits+misses), time.Duration(missTime/int64(misses)))
+	} else if hits > 0 {
+		flog.InfoPrintf("%d hits, 0 misses, 100.00%% hit ratio", hits)
+	}
+	return missing + deleted + errored.report()
 }
 
-func write() {
+func write() uint64 {
 	flog.InfoPrintf("write:")
 	var superseded uint64
+	errored := &errs{}
+	stalled := &stalls{}
+	stallTime := time.Duration(opts.StallTime) * time.Millisecond
 	timestamp := opts.Timestamp
 	if timestamp == 0 {
 		timestamp = 2
@@ -911,6 +1285,7 @@ func write() {
 			}
 			scr := brimio.NewScrambled()
 			var s uint64
+			sc := &stallCounter{limit: stallTime}
 			number := len(opts.keyspace) / 16
 			numberPer := number / opts.Clients
 			var keys []byte
@@ -920,25 +1295,31 @@ func write() {
 				keys = opts.keyspace[numberPer*client*16 : numberPer*(client+1)*16]
 			}
 			if opts.GroupStore {
-				errorCount := 0
-				ctx := context.Background()
 				gs := opts.store.(store.GroupStore)
 				for o := 0; o < len(keys); o += 16 {
 					scr.Read(randomness)
-					if oldTimestamp, err := gs.Write(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), timestamp, value); err != nil {
-						//panic(err)
-						errorCount++
+					wbegin := time.Now()
+					ctx, cancel := opContext()
+					oldTimestamp, err := gs.Write(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), timestamp, value)
+					cancel()
+					sc.observe(time.Now().Sub(wbegin))
+					if err != nil {
+						errored.add(err)
 					} else if oldTimestamp > timestamp {
 						s++
 					}
 				}
 			} else {
-				ctx := context.Background()
 				vs := opts.store.(store.ValueStore)
 				for o := 0; o < len(keys); o += 16 {
 					scr.Read(randomness)
-					if oldTimestamp, err := vs.Write(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), timestamp, value); err != nil {
-						panic(err)
+					wbegin := time.Now()
+					ctx, cancel := opContext()
+					oldTimestamp, err := vs.Write(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), timestamp, value)
+					cancel()
+					sc.observe(time.Now().Sub(wbegin))
+					if err != nil {
+						errored.add(err)
 					} else if oldTimestamp > timestamp {
 						s++
 					}
@@ -947,16 +1328,134 @@ func write() {
 			if s > 0 {
 				atomic.AddUint64(&superseded, s)
 			}
+			stalled.add(sc)
 			wg.Done()
 		}(i)
 	}
 	wg.Wait()
-	opts.store.Flush(context.Background())
+	ctx, cancel := opContext()
+	if err := opts.store.Flush(ctx); err != nil {
+		errored.add(err)
+	}
+	cancel()
 	dur := time.Now().Sub(begin)
 	flog.InfoPrintf("%s %.0f/s %0.2fG/s to write %d values (timestamp %d)", dur, float64(opts.Number)/(float64(dur)/float64(time.Second)), float64(opts.Number*opts.Length)/(float64(dur)/float64(time.Second))/1024/1024/1024, opts.Number, timestamp)
+	recordResult("write", dur, uint64(opts.Number), uint64(opts.Number*opts.Length))
 	if superseded > 0 {
 		flog.ErrorPrintf("%d SUPERCEDED!", superseded)
 	}
+	stalled.report()
+	return superseded + errored.report()
+}
+
+// fingerprint fingerprints the store and, if there is one, the replicated
+// store, reporting if they differ. The number of operations performed is
+// returned; for GroupStore that is the number of items, as with the other
+// group tests.
+func fingerprint() uint64 {
+	flog.InfoPrintf("fingerprint:")
+	begin := time.Now()
+	sum, values := fingerprintStore(opts.store)
+	dur := time.Now().Sub(begin)
+	flog.InfoPrintf("%s %.0f/s to fingerprint %d values: %016x", dur, float64(opts.Number)/(float64(dur)/float64(time.Second)), values, sum)
+	recordResult("fingerprint", dur, uint64(opts.Number), 0)
+	ops := uint64(opts.Number)
+	if opts.GroupStore {
+		ops = values
+	}
+	if opts.repstore != nil {
+		begin = time.Now()
+		rsum, rvalues := fingerprintStore(opts.repstore)
+		dur = time.Now().Sub(begin)
+		flog.InfoPrintf("%s %.0f/s to fingerprint %d replicated values: %016x", dur, float64(opts.Number)/(float64(dur)/float64(time.Second)), rvalues, rsum)
+		if rsum != sum || rvalues != values {
+			flog.ErrorPrintf("FINGERPRINT MISMATCH! %d values %016x, %d replicated values %016x", values, sum, rvalues, rsum)
+		}
+		if opts.GroupStore {
+			ops += rvalues
+		} else {
+			ops += uint64(opts.Number)
+		}
+	}
+	return ops
+}
+
+// fingerprintStore returns a hash over every live (key, timestamp, value)
+// entry in the keyspace, along with how many live entries there were; for a
+// GroupStore every item of each group in the keyspace is included. The
+// per entry hashes are summed so the result does not depend on the number of
+// clients or the order the reads complete in.
+func fingerprintStore(st store.Store) (uint64, uint64) {
+	var sum uint64
+	var values uint64
+	errored := &errs{}
+	wg := &sync.WaitGroup{}
+	wg.Add(opts.Clients)
+	for i := 0; i < opts.Clients; i++ {
+		go func(client int) {
+			var su uint64
+			var v uint64
+			number := len(opts.keyspace) / 16
+			numberPer := number / opts.Clients
+			var keys []byte
+			if client == opts.Clients-1 {
+				keys = opts.keyspace[numberPer*client*16:]
+			} else {
+				keys = opts.keyspace[numberPer*client*16 : numberPer*(client+1)*16]
+			}
+			h := fnv.New64a()
+			b := make([]byte, 24)
+			for o := 0; o < len(keys); o += 16 {
+				if opts.GroupStore {
+					// Every item in the group is hashed, not just the one
+					// written by write, so writegroup's items are covered.
+					ctx, cancel := opContext()
+					items, err := st.(store.GroupStore).ReadGroup(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]))
+					cancel()
+					if store.IsNotFound(err) {
+						continue
+					} else if err != nil {
+						errored.add(err)
+						continue
+					}
+					for _, item := range items {
+						binary.BigEndian.PutUint64(b, item.ChildKeyA)
+						binary.BigEndian.PutUint64(b[8:], item.ChildKeyB)
+						binary.BigEndian.PutUint64(b[16:], uint64(item.TimestampMicro))
+						h.Reset()
+						h.Write(keys[o : o+16])
+						h.Write(b)
+						h.Write(item.Value)
+						su += h.Sum64()
+						v++
+					}
+					continue
+				}
+				ctx, cancel := opContext()
+				timestamp, value, err := st.(store.ValueStore).Read(ctx, binary.BigEndian.Uint64(keys[o:]), binary.BigEndian.Uint64(keys[o+8:]), opts.buffers[client][:0])
+				cancel()
+				if store.IsNotFound(err) {
+					continue
+				} else if err != nil {
+					errored.add(err)
+					continue
+				}
+				binary.BigEndian.PutUint64(b, uint64(timestamp))
+				h.Reset()
+				h.Write(keys[o : o+16])
+				h.Write(b[:8])
+				h.Write(value)
+				su += h.Sum64()
+				v++
+			}
+			atomic.AddUint64(&sum, su)
+			atomic.AddUint64(&values, v)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	errored.report()
+	return sum, values
 }
 
 func run() {
@@ -966,3 +1465,270 @@ func run() {
 	dur := time.Now().Sub(begin)
 	flog.InfoPrintf("%s to run", dur)
 }
+
+// soak repeatedly writes, reads, and looks up the keyspace until
+// opts.SoakTime has passed, optionally cleanly restarting the store(s) each
+// cycle, and reports whether any problems were found along the way.
+func soak() {
+	flog.InfoPrintf("soak:")
+	var problems uint64
+	cycles := 0
+	begin := time.Now()
+	end := begin.Add(time.Duration(opts.SoakTime) * time.Minute)
+	for time.Now().Before(end) {
+		cycles++
+		flog.InfoPrintf("soak cycle %d:", cycles)
+		// Each cycle writes with a newer timestamp so that every cycle
+		// overwrites the values from the previous one.
+		opts.Timestamp += 2
+		problems += write()
+		problems += read()
+		// Only the primary store is checked as replication is asynchronous
+		// and the replicated store may not have caught up yet.
+		problems += lookupStore("", opts.store)
+		if opts.SoakRestart {
+			problems += restart()
+			if opts.storeDown {
+				break
+			}
+			problems += lookupStore("", opts.store)
+		}
+		memstat()
+		if opts.SoakMemory > 0 && float64(opts.st.Sys)/1024/1024/1024 > opts.SoakMemory {
+			flog.ErrorPrintf("%0.2fG memory in use, over the %0.2fG limit", float64(opts.st.Sys)/1024/1024/1024, opts.SoakMemory)
+			problems++
+			break
+		}
+	}
+	dur := time.Now().Sub(begin)
+	if problems > 0 {
+		flog.ErrorPrintf("%s to soak %d cycles: FAIL with %d problems", dur, cycles, problems)
+	} else {
+		flog.InfoPrintf("%s to soak %d cycles: PASS", dur, cycles)
+	}
+}
+
+// audit has the store and, if there is one, the replicated store run a full
+// audit pass, verifying the checksums of their files. The number of audit
+// passes that returned an error is returned.
+func audit() uint64 {
+	flog.InfoPrintf("audit:")
+	var failed uint64
+	begin := time.Now()
+	wg := &sync.WaitGroup{}
+	if opts.repstore != nil {
+		wg.Add(1)
+		go func() {
+			ctx, cancel := opContext()
+			if err := opts.repstore.AuditPass(ctx); err != nil {
+				flog.ErrorPrintf("replicated audit: %s", err)
+				atomic.AddUint64(&failed, 1)
+			}
+			cancel()
+			wg.Done()
+		}()
+	}
+	ctx, cancel := opContext()
+	err := opts.store.AuditPass(ctx)
+	cancel()
+	if err != nil {
+		flog.ErrorPrintf("audit: %s", err)
+		atomic.AddUint64(&failed, 1)
+	}
+	wg.Wait()
+	dur := time.Now().Sub(begin)
+	flog.InfoPrintf("%s to audit", dur)
+	return failed
+}
+
+// corrupt shuts down the store, flips opts.CorruptBytes random bytes in each
+// of its value and TOC files, and starts it again. The corruption counts as
+// detected if the store refuses to start, an audit fails, or the store's
+// fingerprint or value count changed. If the store refuses to start it is left
+// down and any later tests are skipped. The replicated store, if any, is left
+// untouched.
+func corrupt() {
+	flog.InfoPrintf("corrupt:")
+	sum, values := fingerprintStore(opts.store)
+	ctx, cancel := opContext()
+	err := opts.store.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		flog.ErrorPrintf("SHUTDOWN FAILED! %s", err)
+		return
+	}
+	ext := "value"
+	if opts.GroupStore {
+		ext = "group"
+	}
+	rnd := rand.New(rand.NewSource(int64(opts.Random)))
+	var files int
+	for _, pattern := range []string{filepath.Join(opts.path, "*."+ext), filepath.Join(opts.pathTOC, "*."+ext+"toc")} {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			panic(err)
+		}
+		for _, path := range paths {
+			if err := corruptFile(path, opts.CorruptBytes, rnd); err != nil {
+				flog.CriticalPrintf("%s", err)
+				os.Exit(1)
+			}
+			files++
+		}
+	}
+	flog.InfoPrintf("%d bytes flipped in each of %d files", opts.CorruptBytes, files)
+	ctx, cancel = opContext()
+	err = opts.store.Startup(ctx)
+	cancel()
+	if err != nil {
+		flog.InfoPrintf("corruption detected at startup: %s", err)
+		opts.storeDown = true
+		return
+	}
+	if files == 0 {
+		flog.ErrorPrintf("no store files found to corrupt in %s", opts.path)
+		return
+	}
+	failed := audit()
+	csum, cvalues := fingerprintStore(opts.store)
+	if failed > 0 || csum != sum || cvalues != values {
+		flog.InfoPrintf("corruption detected: %d audits failed, %d values before and %d after", failed, values, cvalues)
+	} else {
+		flog.ErrorPrintf("CORRUPTION NOT DETECTED!")
+	}
+}
+
+func corruptFile(path string, count int, rnd *rand.Rand) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if fi.Size() == 0 {
+		return f.Close()
+	}
+	b := make([]byte, 1)
+	for i := 0; i < count; i++ {
+		offset := rnd.Int63n(fi.Size())
+		if _, err = f.ReadAt(b, offset); err != nil {
+			f.Close()
+			return err
+		}
+		b[0] ^= byte(1 + rnd.Intn(255))
+		if _, err = f.WriteAt(b, offset); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// flush flushes the store and, if there is one, the replicated store while
+// leaving them running.
+func flush() {
+	flog.InfoPrintf("flush:")
+	begin := time.Now()
+	wg := &sync.WaitGroup{}
+	if opts.repstore != nil {
+		wg.Add(1)
+		go func() {
+			ctx, cancel := opContext()
+			if err := opts.repstore.Flush(ctx); err != nil {
+				flog.ErrorPrintf("replicated flush: %s", err)
+			}
+			cancel()
+			wg.Done()
+		}()
+	}
+	ctx, cancel := opContext()
+	if err := opts.store.Flush(ctx); err != nil {
+		flog.ErrorPrintf("flush: %s", err)
+	}
+	cancel()
+	wg.Wait()
+	dur := time.Now().Sub(begin)
+	flog.InfoPrintf("%s to flush", dur)
+}
+
+// recoveryCheck starts the already shutdown store given again and verifies
+// it recovered the same content it held before shutdown, as given by the
+// fingerprint sum and values count, and then shuts it down again; name is used
+// to distinguish the output, such as for replicated stores.
+func recoveryCheck(name string, st store.Store, sum uint64, values uint64) {
+	flog.InfoPrintf("%srecovery check:", name)
+	begin := time.Now()
+	ctx, cancel := opContext()
+	err := st.Startup(ctx)
+	cancel()
+	if err != nil {
+		flog.ErrorPrintf("%sRECOVERY FAILED! %s", strings.ToUpper(name), err)
+		return
+	}
+	dur := time.Now().Sub(begin)
+	flog.InfoPrintf("%s to recover", dur)
+	rsum, rvalues := fingerprintStore(st)
+	if rsum != sum || rvalues != values {
+		flog.ErrorPrintf("%sRECOVERY MISMATCH! %d values %016x before shutdown, %d values %016x after", strings.ToUpper(name), values, sum, rvalues, rsum)
+	} else {
+		flog.InfoPrintf("recovered %d %svalues %016x", rvalues, name, rsum)
+	}
+	ctx, cancel = opContext()
+	err = st.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		flog.ErrorPrintf("%sshutdown after recovery check: %s", name, err)
+	}
+}
+
+// restart shuts down and then starts up the store and, if there is one, the
+// replicated store. If a store fails to start again it is left down and any
+// later tests are skipped. The number of shutdowns and startups that failed is
+// returned.
+func restart() uint64 {
+	flog.InfoPrintf("restart:")
+	begin := time.Now()
+	wg := &sync.WaitGroup{}
+	var rfailed uint64
+	rup := true
+	if opts.repstore != nil {
+		wg.Add(1)
+		go func() {
+			rfailed, rup = restartStore("replicated ", opts.repstore)
+			wg.Done()
+		}()
+	}
+	failed, up := restartStore("", opts.store)
+	wg.Wait()
+	if !up || !rup {
+		opts.storeDown = true
+	}
+	dur := time.Now().Sub(begin)
+	flog.InfoPrintf("%s to restart", dur)
+	return failed + rfailed
+}
+
+// restartStore shuts down and then starts up the store given; name is used to
+// distinguish the output, such as for replicated stores. The number of calls
+// that failed is returned, along with whether the store is up again.
+func restartStore(name string, st store.Store) (uint64, bool) {
+	var failed uint64
+	ctx, cancel := opContext()
+	err := st.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		flog.ErrorPrintf("%sSHUTDOWN FAILED! %s", strings.ToUpper(name), err)
+		failed++
+	}
+	ctx, cancel = opContext()
+	err = st.Startup(ctx)
+	cancel()
+	if err != nil {
+		flog.ErrorPrintf("%sRESTART FAILED! %s", strings.ToUpper(name), err)
+		return failed + 1, false
+	}
+	return failed, true
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type result struct {
+	test  string
+	run   int
+	dur   time.Duration
+	count uint64
+	bytes uint64
+}
+
+// recordResult keeps the outcome of a test for writeOpenMetrics; count is the
+// number of operations performed and bytes the value bytes moved, if any.
+func recordResult(test string, dur time.Duration, count uint64, bytes uint64) {
+	run := 1
+	for _, r := range opts.results {
+		if r.test == test {
+			run++
+		}
+	}
+	opts.results = append(opts.results, result{test: test, run: run, dur: dur, count: count, bytes: bytes})
+}
+
+// writeOpenMetrics writes the recorded results to the path given in the
+// OpenMetrics text format, suitable for a textfile collector or pushing to a
+// Pushgateway.
+func writeOpenMetrics(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	storeType := "value"
+	if opts.GroupStore {
+		storeType = "group"
+	}
+	for _, m := range []struct {
+		name  string
+		help  string
+		value func(r result) float64
+	}{
+		{"store_testing_duration_seconds", "Time taken by the test.", func(r result) float64 { return r.dur.Seconds() }},
+		{"store_testing_operations", "Operations performed by the test.", func(r result) float64 { return float64(r.count) }},
+		{"store_testing_operations_per_second", "Operations per second achieved by the test.", func(r result) float64 { return float64(r.count) / r.dur.Seconds() }},
+		{"store_testing_bytes_per_second", "Value bytes per second achieved by the test.", func(r result) float64 { return float64(r.bytes) / r.dur.Seconds() }},
+	} {
+		fmt.Fprintf(w, "# TYPE %s gauge\n", m.name)
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		for _, r := range opts.results {
+			fmt.Fprintf(w, "%s{store=%q,test=%q,run=\"%d\",clients=\"%d\",length=\"%d\"} %g\n", m.name, storeType, r.test, r.run, opts.Clients, opts.Length, m.value(r))
+		}
+	}
+	fmt.Fprintf(w, "# EOF\n")
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readOpenMetrics reads a file written by writeOpenMetrics and returns the
+// values of the metric named, keyed by "test run" along with those keys in
+// the order they were first seen.
+func readOpenMetrics(path string, metric string) (map[string]float64, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	values := make(map[string]float64)
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, metric+"{") {
+			continue
+		}
+		end := strings.LastIndex(line, "} ")
+		if end < 0 {
+			return nil, nil, fmt.Errorf("%s: malformed line %q", path, line)
+		}
+		labels := make(map[string]string)
+		for _, label := range strings.Split(line[len(metric)+1:end], ",") {
+			parts := strings.SplitN(label, "=", 2)
+			if len(parts) == 2 {
+				labels[parts[0]] = strings.Trim(parts[1], "\"")
+			}
+		}
+		v, err := strconv.ParseFloat(line[end+2:], 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: malformed value in %q: %s", path, line, err)
+		}
+		key := labels["test"] + " " + labels["run"]
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = v
+	}
+	return values, keys, scanner.Err()
+}
+
+// compareOpenMetrics writes a side by side comparison of the operations per
+// second recorded in each of the files given, such as from runs of different
+// store configurations.
+func compareOpenMetrics(paths []string) error {
+	var keys []string
+	seen := make(map[string]bool)
+	results := make([]map[string]float64, len(paths))
+	for i, path := range paths {
+		values, k, err := readOpenMetrics(path, "store_testing_operations_per_second")
+		if err != nil {
+			return err
+		}
+		results[i] = values
+		for _, key := range k {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(w, "test run\t")
+	for _, path := range paths {
+		fmt.Fprintf(w, "%s\t", path)
+	}
+	fmt.Fprintln(w)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t", key)
+		for _, values := range results {
+			if v, ok := values[key]; ok {
+				fmt.Fprintf(w, "%.0f/s\t", v)
+			} else {
+				fmt.Fprint(w, "-\t")
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}